@@ -21,7 +21,10 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -29,8 +32,16 @@ import (
 	"io/ioutil"
 	"log"
 	"math"
+	"math/bits"
+	mathrand "math/rand"
 	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
 	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,6 +50,60 @@ var fDuration = flag.Duration("duration", 5*time.Second, "How long to run.")
 var fFileSize = flag.Int64("file_size", 1<<20, "Size of file to use.")
 var fReadSize = flag.Int64("read_size", 1<<14, "Size of each call to read(2).")
 
+var fConcurrency = flag.Int(
+	"concurrency",
+	0,
+	"If positive, run this many goroutines reading concurrently from "+
+		"--files temporary files, instead of the single-threaded loop.")
+
+var fFiles = flag.Int(
+	"files",
+	1,
+	"Number of temporary files to create and read from in concurrent mode.")
+
+var fMode = flag.String(
+	"mode",
+	"sequential",
+	"Access pattern to use when reading the file: sequential, random, or stride.")
+
+var fStride = flag.Int64(
+	"stride",
+	1<<14,
+	"In stride mode, the number of bytes to advance the offset between "+
+		"reads, wrapping around at the end of the file.")
+
+var fOutputFormat = flag.String(
+	"output_format",
+	"text",
+	"Format for measurement output: text, json, or csv.")
+
+var fOutputFile = flag.String(
+	"output_file",
+	"",
+	"If set, write json or csv output here instead of to stdout. "+
+		"Text output always goes to stdout.")
+
+var fCPUProfile = flag.String(
+	"cpuprofile",
+	"",
+	"If set, write a CPU profile to this path.")
+
+var fMemProfile = flag.String(
+	"memprofile",
+	"",
+	"If set, write a heap profile to this path after the run.")
+
+var fTraceFile = flag.String(
+	"trace",
+	"",
+	"If set, write an execution trace to this path.")
+
+var fHistPrecision = flag.Int(
+	"hist_precision",
+	3,
+	"Number of significant decimal figures of resolution to keep in the "+
+		"read(2) latency histogram. Clamped to [1, 5].")
+
 ////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////
@@ -85,6 +150,312 @@ func percentile(
 	}
 }
 
+type Int64Slice []int64
+
+func (p Int64Slice) Len() int           { return len(p) }
+func (p Int64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p Int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// REQUIRES: vals is sorted.
+// REQUIRES: len(vals) > 0
+// REQUIRES: 0 <= p <= 100
+func percentileInt64(
+	vals Int64Slice,
+	p int) (x int64) {
+	// Same NIST method as percentile above, just over int64 rather than
+	// time.Duration.
+	N := len(vals)
+	rank := (float64(p) / 100) * float64(N+1)
+	kFloat, d := math.Modf(rank)
+	k := int(kFloat)
+
+	switch {
+	case k == 0:
+		x = vals[0]
+		return
+
+	case k >= N:
+		x = vals[N-1]
+		return
+
+	case 0 < k && k < N:
+		xFloat := float64(vals[k-1]) + d*float64(vals[k]-vals[k-1])
+		x = int64(xFloat)
+		return
+
+	default:
+		panic("Invalid input")
+	}
+}
+
+func abs64(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
+
+////////////////////////////////////////////////////////////////////////
+// Histogram
+////////////////////////////////////////////////////////////////////////
+
+// The upper end of the dynamic range covered by a Histogram, chosen to
+// comfortably bracket read(2) latencies up to a very slow network-backed
+// read. Values are clamped to this on the high end; on the low end only zero
+// is raised, to 1ns; see bucketIndex.
+const histMaxNs uint64 = 100 * 1000 * 1000000 // 100s, in nanoseconds
+
+// A histogram of time.Duration observations that buckets on a logarithmic
+// scale: values are grouped by the position of their highest set bit
+// ("shift"), and each such group is further divided into subBucketCount
+// linear sub-buckets, giving roughly --hist_precision significant decimal
+// figures of resolution throughout. Record does a fixed number of atomic
+// operations and no allocation, so it's safe to call at a high rate from
+// many goroutines at once (see the concurrent mode below), unlike appending
+// every observation to a DurationSlice and sorting it at the end.
+//
+// Note that the *number* of buckets allocated depends on the dynamic range
+// above as well as subBucketCount, not on subBucketCount alone; "N
+// significant figures" bounds the relative error of a reported percentile,
+// not the memory footprint directly.
+type Histogram struct {
+	subBucketBits int    // log2(subBucketCount)
+	subBucketMask uint64 // subBucketCount - 1
+
+	counts []uint64 // atomic
+
+	min uint64 // atomic, nanoseconds; 0 means "no observations yet"
+	max uint64 // atomic, nanoseconds
+	sum uint64 // atomic, nanoseconds
+	n   uint64 // atomic
+}
+
+// maxHistPrecision bounds --hist_precision. Above this, subBucketCount grows
+// large enough that pow10Int overflows int (producing a degenerate,
+// silently-wrong histogram) or, before that point, numBuckets grows large
+// enough that make([]uint64, numBuckets) panics with "len out of range".
+// Five significant figures is already far more resolution than a read(2)
+// latency distribution needs.
+const maxHistPrecision = 5
+
+// NewHistogram returns a Histogram with the given number of significant
+// decimal figures of precision, clamped to [1, maxHistPrecision].
+func NewHistogram(precision int) *Histogram {
+	if precision < 1 {
+		precision = 1
+	}
+	if precision > maxHistPrecision {
+		precision = maxHistPrecision
+	}
+
+	subBucketCount := 1
+	for subBucketCount < pow10Int(precision) {
+		subBucketCount <<= 1
+	}
+	subBucketBits := bits.Len64(uint64(subBucketCount)) - 1
+
+	maxShift := 0
+	if bits.Len64(histMaxNs) > subBucketBits {
+		maxShift = bits.Len64(histMaxNs) - subBucketBits
+	}
+
+	// Only shift 0 uses the full [0, subBucketCount) row: as bucketIndex
+	// explains, every shift >= 1 only ever populates the upper half of its
+	// row, since the lower half is already covered by the previous shift at
+	// finer resolution. So each additional shift beyond the first only needs
+	// subBucketCount/2 buckets, not subBucketCount.
+	numBuckets := subBucketCount + maxShift*(subBucketCount/2)
+
+	return &Histogram{
+		subBucketBits: subBucketBits,
+		subBucketMask: uint64(subBucketCount - 1),
+		counts:        make([]uint64, numBuckets),
+	}
+}
+
+func pow10Int(p int) int {
+	v := 1
+	for i := 0; i < p; i++ {
+		v *= 10
+	}
+	return v
+}
+
+// bucketIndex maps a nanosecond count, clamped to histMaxNs, to an index
+// into h.counts. Values below subBucketCount get one bucket per nanosecond,
+// using the whole row. Above that, values are right-shifted by enough bits
+// to land in [subBucketCount/2, subBucketCount): the lower half of that
+// range, [0, subBucketCount/2), would have been covered already by the
+// previous (finer) shift, so only the upper half is ever reached here and
+// only that half needs storage, which is why rows for shift >= 1 are packed
+// subBucketCount/2 (not subBucketCount) apart below.
+func (h *Histogram) bucketIndex(ns uint64) int {
+	if ns > histMaxNs {
+		ns = histMaxNs
+	}
+	if ns == 0 {
+		ns = 1
+	}
+
+	subBucketCount := int(h.subBucketMask + 1)
+	subBucketHalfCount := subBucketCount / 2
+
+	shift := bits.Len64(ns) - h.subBucketBits
+	if shift < 0 {
+		shift = 0
+	}
+
+	sub := int((ns >> uint(shift)) & h.subBucketMask)
+
+	var idx int
+	if shift == 0 {
+		idx = sub
+	} else {
+		idx = subBucketCount + (shift-1)*subBucketHalfCount + (sub - subBucketHalfCount)
+	}
+
+	if idx >= len(h.counts) {
+		idx = len(h.counts) - 1
+	}
+
+	return idx
+}
+
+// bucketRange returns the half-open [lo, hi) nanosecond range that bucket
+// idx covers, the inverse of bucketIndex.
+func (h *Histogram) bucketRange(idx int) (lo, hi uint64) {
+	subBucketCount := int(h.subBucketMask + 1)
+	subBucketHalfCount := subBucketCount / 2
+
+	if idx < subBucketCount {
+		lo = uint64(idx)
+		hi = lo + 1
+		return
+	}
+
+	rem := idx - subBucketCount
+	shift := uint(rem/subBucketHalfCount) + 1
+	sub := uint64(rem%subBucketHalfCount + subBucketHalfCount)
+
+	lo = sub << shift
+	hi = lo + (1 << shift)
+	return
+}
+
+// Record adds one observation of duration d to the histogram. Safe to call
+// concurrently from multiple goroutines.
+func (h *Histogram) Record(d time.Duration) {
+	ns := uint64(d.Nanoseconds())
+	if ns == 0 {
+		ns = 1
+	}
+
+	atomic.AddUint64(&h.counts[h.bucketIndex(ns)], 1)
+	atomic.AddUint64(&h.sum, ns)
+	atomic.AddUint64(&h.n, 1)
+
+	for {
+		cur := atomic.LoadUint64(&h.min)
+		if cur != 0 && cur <= ns {
+			break
+		}
+		if atomic.CompareAndSwapUint64(&h.min, cur, ns) {
+			break
+		}
+	}
+
+	for {
+		cur := atomic.LoadUint64(&h.max)
+		if cur >= ns {
+			break
+		}
+		if atomic.CompareAndSwapUint64(&h.max, cur, ns) {
+			break
+		}
+	}
+}
+
+// Count returns the number of observations recorded so far.
+func (h *Histogram) Count() uint64 { return atomic.LoadUint64(&h.n) }
+
+// Mean returns the mean of all observations recorded so far.
+func (h *Histogram) Mean() time.Duration {
+	n := atomic.LoadUint64(&h.n)
+	if n == 0 {
+		return 0
+	}
+
+	return time.Duration(atomic.LoadUint64(&h.sum) / n)
+}
+
+// Min returns the smallest observation recorded so far.
+func (h *Histogram) Min() time.Duration { return time.Duration(atomic.LoadUint64(&h.min)) }
+
+// Max returns the largest observation recorded so far.
+func (h *Histogram) Max() time.Duration { return time.Duration(atomic.LoadUint64(&h.max)) }
+
+// Percentile walks the buckets in order, accumulating counts until it
+// reaches the one containing rank p (0 <= p <= 100), then linearly
+// interpolates within that bucket's range.
+//
+// REQUIRES: at least one observation has been recorded.
+func (h *Histogram) Percentile(p float64) time.Duration {
+	total := atomic.LoadUint64(&h.n)
+	if total == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(p / 100 * float64(total)))
+	if target == 0 {
+		target = 1
+	}
+
+	var cum uint64
+	for idx := range h.counts {
+		c := atomic.LoadUint64(&h.counts[idx])
+		if c == 0 {
+			continue
+		}
+
+		cum += c
+		if cum >= target {
+			lo, hi := h.bucketRange(idx)
+			frac := 1 - float64(cum-target)/float64(c)
+			ns := float64(lo) + frac*float64(hi-lo)
+			return time.Duration(ns)
+		}
+	}
+
+	return time.Duration(atomic.LoadUint64(&h.max))
+}
+
+// Create a temporary file in dir, fill it with size random bytes, and close
+// it. Returns the path to the file.
+func createRandomFile(dir string, size int64) (path string, err error) {
+	f, err := ioutil.TempFile(dir, "sequential_read")
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	path = f.Name()
+
+	_, err = io.Copy(f, io.LimitReader(rand.Reader, size))
+	if err != nil {
+		err = fmt.Errorf("Copying random bytes: %v", err)
+		return
+	}
+
+	err = f.Close()
+	if err != nil {
+		err = fmt.Errorf("Closing file: %v", err)
+		return
+	}
+
+	return
+}
+
 func formatBytes(v float64) string {
 	switch {
 	case v >= 1<<30:
@@ -105,6 +476,92 @@ func formatBytes(v float64) string {
 // main logic
 ////////////////////////////////////////////////////////////////////////
 
+// readOnePass reads f once according to --mode, recording per-read latencies
+// into hist, bytes successfully read into bytesRead, and, in random/stride
+// mode, seek distances into *seekDistances. *prevOffset tracks the offset of
+// the previous ReadAt, carried across passes (each worker keeps its own in
+// concurrent mode); -1 means no read has happened yet. Sequential mode
+// neither reads nor updates it.
+// Shared by the single-threaded path in run() and the worker pool in
+// readWorker(), so --mode behaves identically in both.
+func readOnePass(
+	f *os.File,
+	buf []byte,
+	hist *Histogram,
+	seekDistances *Int64Slice,
+	prevOffset *int64) (bytesRead int64, err error) {
+	switch *fMode {
+	case "sequential":
+		for {
+			readStartTime := time.Now()
+			var n int
+			n, err = f.Read(buf)
+			hist.Record(time.Since(readStartTime))
+			bytesRead += int64(n)
+			if err != nil {
+				break
+			}
+		}
+
+		if err == io.EOF {
+			err = nil
+		}
+
+		return
+
+	case "random", "stride":
+		maxOffset := *fFileSize - *fReadSize
+		if maxOffset < 0 {
+			maxOffset = 0
+		}
+
+		reads := *fFileSize / *fReadSize
+		if reads == 0 {
+			reads = 1
+		}
+
+		offset := int64(0)
+		for i := int64(0); i < reads; i++ {
+			if *fMode == "random" {
+				offset = mathrand.Int63n(maxOffset + 1)
+			}
+
+			if *prevOffset >= 0 {
+				*seekDistances = append(*seekDistances, abs64(offset-*prevOffset))
+			}
+			*prevOffset = offset
+
+			readStartTime := time.Now()
+			var n int
+			n, err = f.ReadAt(buf, offset)
+			hist.Record(time.Since(readStartTime))
+			bytesRead += int64(n)
+
+			// Unlike a sequential Read, a single ReadAt can legitimately
+			// return io.EOF on every call here: if --read_size exceeds
+			// --file_size, maxOffset is clamped to 0 and every read asks for
+			// more bytes than the file has. That's a degenerate but valid
+			// measurement, not a failure, so don't abort the run over it.
+			if err != nil && err != io.EOF {
+				return
+			}
+			err = nil
+
+			if *fMode == "stride" {
+				offset += *fStride
+				if offset > maxOffset {
+					offset %= maxOffset + 1
+				}
+			}
+		}
+
+		return
+
+	default:
+		return 0, fmt.Errorf("Unknown --mode %q", *fMode)
+	}
+}
+
 func run() (err error) {
 	if *fDir == "" {
 		err = errors.New("You must set --dir.")
@@ -114,45 +571,40 @@ func run() (err error) {
 	// Create a temporary file.
 	log.Printf("Creating a temporary file in %s.", *fDir)
 
-	f, err := ioutil.TempFile(*fDir, "sequential_read")
+	path, err := createRandomFile(*fDir, *fFileSize)
 	if err != nil {
-		err = fmt.Errorf("TempFile: %v", err)
+		err = fmt.Errorf("createRandomFile: %v", err)
 		return
 	}
 
-	path := f.Name()
-
 	// Make sure we clean it up later.
 	defer func() {
 		log.Printf("Deleting %s.", path)
 		os.Remove(path)
 	}()
 
-	// Fill it with random content.
-	log.Printf("Writing %d random bytes.", *fFileSize)
-	_, err = io.Copy(f, io.LimitReader(rand.Reader, *fFileSize))
-	if err != nil {
-		err = fmt.Errorf("Copying random bytes: %v", err)
-		return
-	}
-
-	// Finish off the file.
-	err = f.Close()
-	if err != nil {
-		err = fmt.Errorf("Closing file: %v", err)
-		return
-	}
-
 	// Run several iterations.
 	log.Printf("Measuring for %v...", *fDuration)
 
 	var fullFileRead DurationSlice
-	var singleReadCall DurationSlice
+	var seekDistances Int64Slice
 	buf := make([]byte, *fReadSize)
 
+	// read(2) latencies are recorded into a histogram rather than a
+	// DurationSlice: at multi-GB/s this stream is by far the highest-volume
+	// one, and a histogram records each observation in O(1) time and space
+	// instead of growing an unbounded slice that must be sorted at the end.
+	singleReadCall := NewHistogram(*fHistPrecision)
+
+	// prevOffset tracks the offset of the previous read, across file passes,
+	// so that the seek distances cover the whole run. -1 means no
+	// read has happened yet.
+	prevOffset := int64(-1)
+
 	overallStartTime := time.Now()
 	for len(fullFileRead) == 0 || time.Since(overallStartTime) < *fDuration {
 		// Open the file for reading.
+		var f *os.File
 		f, err = os.Open(path)
 		if err != nil {
 			err = fmt.Errorf("Opening file: %v", err)
@@ -161,19 +613,10 @@ func run() (err error) {
 
 		// Read the whole thing.
 		fileStartTime := time.Now()
-		for err == nil {
-			readStartTime := time.Now()
-			_, err = f.Read(buf)
-			singleReadCall = append(singleReadCall, time.Since(readStartTime))
-		}
-
+		_, err = readOnePass(f, buf, singleReadCall, &seekDistances, &prevOffset)
 		fullFileRead = append(fullFileRead, time.Since(fileStartTime))
 
-		switch {
-		case err == io.EOF:
-			err = nil
-
-		case err != nil:
+		if err != nil {
 			err = fmt.Errorf("Reading: %v", err)
 			return
 		}
@@ -187,38 +630,532 @@ func run() (err error) {
 	}
 
 	sort.Sort(fullFileRead)
-	sort.Sort(singleReadCall)
 
 	log.Printf(
 		"Read the file %d times, using %d calls to read(2).",
 		len(fullFileRead),
-		len(singleReadCall))
+		singleReadCall.Count())
+
+	if len(seekDistances) > 0 {
+		sort.Sort(seekDistances)
+	}
 
 	// Report.
-	ptiles := []int{50, 90, 98}
+	err = report(fullFileRead, singleReadCall, seekDistances)
+	return
+}
+
+// The percentiles reported for each observed metric.
+var ptiles = []int{50, 90, 98}
 
-	reportSlice := func(
-		name string,
-		bytesPerObservation int64,
-		observations DurationSlice) {
-		fmt.Printf("\n%s:\n", name)
-		for _, ptile := range ptiles {
-			d := percentile(observations, ptile)
-			seconds := float64(d) / float64(time.Second)
-			bandwidthBytesPerSec := float64(bytesPerObservation) / seconds
+func reportSlice(
+	name string,
+	bytesPerObservation int64,
+	observations DurationSlice,
+	ptiles []int) {
+	fmt.Printf("\n%s:\n", name)
 
-			fmt.Printf(
-				"  %02dth ptile: %10v (%s/s)\n",
-				ptile,
-				d,
-				formatBytes(bandwidthBytesPerSec))
+	if len(observations) == 0 {
+		fmt.Println("  no data")
+		return
+	}
+
+	for _, ptile := range ptiles {
+		d := percentile(observations, ptile)
+		seconds := float64(d) / float64(time.Second)
+		bandwidthBytesPerSec := float64(bytesPerObservation) / seconds
+
+		fmt.Printf(
+			"  %02dth ptile: %10v (%s/s)\n",
+			ptile,
+			d,
+			formatBytes(bandwidthBytesPerSec))
+	}
+}
+
+// reportDistances prints percentiles of a sorted slice of raw values (e.g.
+// byte distances) rather than durations, reusing the ptile machinery above.
+func reportDistances(
+	name string,
+	observations Int64Slice,
+	ptiles []int) {
+	fmt.Printf("\n%s:\n", name)
+	for _, ptile := range ptiles {
+		d := percentileInt64(observations, ptile)
+		fmt.Printf("  %02dth ptile: %10d bytes\n", ptile, d)
+	}
+}
+
+// reportHistogram is the Histogram analog of reportSlice.
+func reportHistogram(
+	name string,
+	bytesPerObservation int64,
+	h *Histogram,
+	ptiles []int) {
+	fmt.Printf("\n%s:\n", name)
+	for _, ptile := range ptiles {
+		d := h.Percentile(float64(ptile))
+		seconds := float64(d) / float64(time.Second)
+		bandwidthBytesPerSec := float64(bytesPerObservation) / seconds
+
+		fmt.Printf(
+			"  %02dth ptile: %10v (%s/s)\n",
+			ptile,
+			d,
+			formatBytes(bandwidthBytesPerSec))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Machine-readable output
+////////////////////////////////////////////////////////////////////////
+
+// The percentiles included in the full machine-readable report. These are
+// finer-grained than the text summary's ptiles above, since CI consumers
+// often care about the tail.
+var jsonPtiles = []float64{50, 90, 95, 98, 99, 99.9}
+
+type jsonConfig struct {
+	Dir      string `json:"dir"`
+	FileSize int64  `json:"file_size"`
+	ReadSize int64  `json:"read_size"`
+	Duration string `json:"duration"`
+}
+
+type jsonCounts struct {
+	Iterations int `json:"iterations"`
+	ReadCalls  int `json:"read_calls"`
+}
+
+type jsonMetric struct {
+	Name        string             `json:"name"`
+	Unit        string             `json:"unit"`
+	Count       int                `json:"count"`
+	Mean        float64            `json:"mean"`
+	StdDev      float64            `json:"stddev"`
+	Percentiles map[string]float64 `json:"percentiles"`
+
+	// Values holds the full sorted observation array, in Unit units. Omitted
+	// for metrics backed by a Histogram, which doesn't retain individual
+	// observations.
+	Values []float64 `json:"values,omitempty"`
+}
+
+type jsonReport struct {
+	Config  jsonConfig   `json:"config"`
+	Counts  jsonCounts   `json:"counts"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+// ptileKey formats a percentile such as 99.9 as "p99.9" and 50 as "p50".
+func ptileKey(p float64) string {
+	if p == math.Trunc(p) {
+		return fmt.Sprintf("p%d", int(p))
+	}
+
+	return fmt.Sprintf("p%g", p)
+}
+
+// meanAndStdDev returns the mean and population standard deviation of vals.
+func meanAndStdDev(vals []float64) (mean, stdDev float64) {
+	if len(vals) == 0 {
+		return
+	}
+
+	var sum float64
+	for _, v := range vals {
+		sum += v
+	}
+	mean = sum / float64(len(vals))
+
+	var sqDiffSum float64
+	for _, v := range vals {
+		d := v - mean
+		sqDiffSum += d * d
+	}
+	stdDev = math.Sqrt(sqDiffSum / float64(len(vals)))
+
+	return
+}
+
+// percentilesFloat64 computes ps over the sorted slice vals using the same
+// NIST method as percentile/percentileInt64 above.
+func percentilesFloat64(vals []float64, ps []float64) map[string]float64 {
+	result := make(map[string]float64, len(ps))
+	N := len(vals)
+
+	if N == 0 {
+		return result
+	}
+
+	for _, p := range ps {
+		rank := (p / 100) * float64(N+1)
+		kFloat, d := math.Modf(rank)
+		k := int(kFloat)
+
+		var x float64
+		switch {
+		case k <= 0:
+			x = vals[0]
+		case k >= N:
+			x = vals[N-1]
+		default:
+			x = vals[k-1] + d*(vals[k]-vals[k-1])
 		}
+
+		result[ptileKey(p)] = x
 	}
 
-	reportSlice("Full-file read times", *fFileSize, fullFileRead)
-	reportSlice("read(2) latencies", *fReadSize, singleReadCall)
+	return result
+}
+
+func durationsToNanos(vals DurationSlice) []float64 {
+	out := make([]float64, len(vals))
+	for i, v := range vals {
+		out[i] = float64(v.Nanoseconds())
+	}
+	return out
+}
+
+func int64sToFloat64s(vals Int64Slice) []float64 {
+	out := make([]float64, len(vals))
+	for i, v := range vals {
+		out[i] = float64(v)
+	}
+	return out
+}
+
+func buildMetric(name, unit string, vals []float64) jsonMetric {
+	mean, stdDev := meanAndStdDev(vals)
+	return jsonMetric{
+		Name:        name,
+		Unit:        unit,
+		Count:       len(vals),
+		Mean:        mean,
+		StdDev:      stdDev,
+		Percentiles: percentilesFloat64(vals, jsonPtiles),
+		Values:      vals,
+	}
+}
+
+// buildMetricFromHistogram is the Histogram analog of buildMetric. A
+// Histogram doesn't track sum-of-squares, so StdDev is left zero and Values
+// is left empty; Count/Mean/Percentiles come straight from the histogram.
+func buildMetricFromHistogram(name, unit string, h *Histogram, ps []float64) jsonMetric {
+	percentiles := make(map[string]float64, len(ps))
+	for _, p := range ps {
+		percentiles[ptileKey(p)] = float64(h.Percentile(p))
+	}
+
+	return jsonMetric{
+		Name:        name,
+		Unit:        unit,
+		Count:       int(h.Count()),
+		Mean:        float64(h.Mean()),
+		Percentiles: percentiles,
+	}
+}
+
+// report writes the measurement results in the format requested by
+// --output_format. json and csv output goes to --output_file if set or to
+// stdout otherwise; text output always goes to stdout.
+func report(
+	fullFileRead DurationSlice,
+	singleReadCall *Histogram,
+	seekDistances Int64Slice) (err error) {
+	switch *fOutputFormat {
+	case "", "text":
+		reportSlice("Full-file read times", *fFileSize, fullFileRead, ptiles)
+		reportHistogram("read(2) latencies", *fReadSize, singleReadCall, ptiles)
+
+		if len(seekDistances) > 0 {
+			reportDistances("Seek distances", seekDistances, ptiles)
+		}
+
+		fmt.Println()
+		return
+
+	case "json":
+		rep := jsonReport{
+			Config: jsonConfig{
+				Dir:      *fDir,
+				FileSize: *fFileSize,
+				ReadSize: *fReadSize,
+				Duration: fDuration.String(),
+			},
+			Counts: jsonCounts{
+				Iterations: len(fullFileRead),
+				ReadCalls:  int(singleReadCall.Count()),
+			},
+		}
+
+		rep.Metrics = append(rep.Metrics, buildMetric(
+			"full_file_read", "ns", durationsToNanos(fullFileRead)))
+		rep.Metrics = append(rep.Metrics, buildMetricFromHistogram(
+			"read_call", "ns", singleReadCall, jsonPtiles))
+
+		if len(seekDistances) > 0 {
+			rep.Metrics = append(rep.Metrics, buildMetric(
+				"seek_distance", "bytes", int64sToFloat64s(seekDistances)))
+		}
+
+		var data []byte
+		data, err = json.MarshalIndent(rep, "", "  ")
+		if err != nil {
+			err = fmt.Errorf("Marshaling JSON: %v", err)
+			return
+		}
+
+		return writeOutput(append(data, '\n'))
+
+	case "csv":
+		metrics := []jsonMetric{
+			buildMetric("full_file_read", "ns", durationsToNanos(fullFileRead)),
+			buildMetricFromHistogram("read_call", "ns", singleReadCall, jsonPtiles),
+		}
+
+		if len(seekDistances) > 0 {
+			metrics = append(metrics, buildMetric(
+				"seek_distance", "bytes", int64sToFloat64s(seekDistances)))
+		}
+
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+
+		header := []string{"metric", "unit", "count", "mean", "stddev"}
+		for _, p := range jsonPtiles {
+			header = append(header, ptileKey(p))
+		}
+		if err = w.Write(header); err != nil {
+			return fmt.Errorf("Writing CSV header: %v", err)
+		}
+
+		for _, m := range metrics {
+			row := []string{
+				m.Name,
+				m.Unit,
+				strconv.Itoa(m.Count),
+				strconv.FormatFloat(m.Mean, 'f', -1, 64),
+				strconv.FormatFloat(m.StdDev, 'f', -1, 64),
+			}
+			for _, p := range jsonPtiles {
+				row = append(row, strconv.FormatFloat(m.Percentiles[ptileKey(p)], 'f', -1, 64))
+			}
+			if err = w.Write(row); err != nil {
+				return fmt.Errorf("Writing CSV row: %v", err)
+			}
+		}
+
+		w.Flush()
+		if err = w.Error(); err != nil {
+			return fmt.Errorf("Flushing CSV: %v", err)
+		}
 
-	fmt.Println()
+		return writeOutput(buf.Bytes())
+
+	default:
+		return fmt.Errorf("Unknown --output_format %q", *fOutputFormat)
+	}
+}
+
+// writeOutput writes data to --output_file if set, otherwise to stdout.
+func writeOutput(data []byte) (err error) {
+	if *fOutputFile == "" {
+		_, err = os.Stdout.Write(data)
+		return
+	}
+
+	err = ioutil.WriteFile(*fOutputFile, data, 0644)
+	if err != nil {
+		err = fmt.Errorf("Writing %s: %v", *fOutputFile, err)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Concurrent mode
+////////////////////////////////////////////////////////////////////////
+
+// The result of running one worker goroutine in concurrent mode.
+type workerResult struct {
+	bytesRead     int64
+	fullFileRead  DurationSlice
+	seekDistances Int64Slice
+}
+
+// Repeatedly open path and read it according to --mode via readOnePass,
+// recording per-read latencies into hist and per-file durations (and, in
+// random/stride mode, seek distances) into the result, until stop is closed.
+// hist is shared across all workers: Record is lock-free, so there's no
+// contention even with --concurrency workers all hammering it at once.
+func readWorker(
+	path string,
+	buf []byte,
+	hist *Histogram,
+	stop <-chan struct{}) (result workerResult, err error) {
+	prevOffset := int64(-1)
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return result, fmt.Errorf("Opening file: %v", err)
+		}
+
+		fileStartTime := time.Now()
+		n, readErr := readOnePass(f, buf, hist, &result.seekDistances, &prevOffset)
+		result.bytesRead += n
+
+		if readErr != nil {
+			f.Close()
+			return result, fmt.Errorf("Reading: %v", readErr)
+		}
+
+		result.fullFileRead = append(result.fullFileRead, time.Since(fileStartTime))
+
+		if err = f.Close(); err != nil {
+			return result, fmt.Errorf("Closing file after reading: %v", err)
+		}
+	}
+}
+
+// Create *fFiles temporary files and read them concurrently from
+// *fConcurrency goroutines for *fDuration. With text output this reports
+// aggregate throughput and per-worker full-file read percentiles; json and
+// csv output carry only the aggregates that report() writes.
+func runConcurrent() (err error) {
+	if *fDir == "" {
+		err = errors.New("You must set --dir.")
+		return
+	}
+
+	if *fFiles < 1 {
+		err = errors.New("You must set --files to a positive value.")
+		return
+	}
+
+	// Create the temporary files that the workers will read from, round-robin.
+	log.Printf("Creating %d temporary file(s) in %s.", *fFiles, *fDir)
+
+	paths := make([]string, *fFiles)
+	for i := range paths {
+		paths[i], err = createRandomFile(*fDir, *fFileSize)
+		if err != nil {
+			err = fmt.Errorf("createRandomFile: %v", err)
+			return
+		}
+	}
+
+	defer func() {
+		for _, p := range paths {
+			log.Printf("Deleting %s.", p)
+			os.Remove(p)
+		}
+	}()
+
+	// Run the workers for the measurement window.
+	log.Printf(
+		"Measuring for %v with %d worker(s)...",
+		*fDuration,
+		*fConcurrency)
+
+	// read(2) latencies across all workers are recorded into one shared
+	// histogram rather than per-worker slices; see readWorker.
+	hist := NewHistogram(*fHistPrecision)
+
+	var mu sync.Mutex
+	results := make([]workerResult, *fConcurrency)
+	workerErrs := make([]error, *fConcurrency)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	overallStartTime := time.Now()
+	for i := 0; i < *fConcurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			path := paths[i%len(paths)]
+			buf := make([]byte, *fReadSize)
+
+			result, workerErr := readWorker(path, buf, hist, stop)
+
+			mu.Lock()
+			results[i] = result
+			workerErrs[i] = workerErr
+			mu.Unlock()
+		}(i)
+	}
+
+	time.Sleep(*fDuration)
+	close(stop)
+	wg.Wait()
+
+	elapsed := time.Since(overallStartTime)
+
+	for _, workerErr := range workerErrs {
+		if workerErr != nil {
+			return workerErr
+		}
+	}
+
+	// Aggregate bytes, full-file read durations, and seek distances across
+	// all workers. The aggregates (not the per-worker breakdowns below) are
+	// what get handed to report(), so --output_format=json/csv works the
+	// same way here as in the single-threaded path.
+	var totalBytes int64
+	var aggregateFullFileRead DurationSlice
+	var seekDistances Int64Slice
+	isText := *fOutputFormat == "" || *fOutputFormat == "text"
+	for i, result := range results {
+		totalBytes += result.bytesRead
+		aggregateFullFileRead = append(aggregateFullFileRead, result.fullFileRead...)
+		seekDistances = append(seekDistances, result.seekDistances...)
+
+		if isText {
+			log.Printf(
+				"Worker %d: read the file %d times.",
+				i,
+				len(result.fullFileRead))
+
+			sort.Sort(result.fullFileRead)
+
+			reportSlice(
+				fmt.Sprintf("Worker %d: full-file read times", i),
+				*fFileSize,
+				result.fullFileRead,
+				ptiles)
+		}
+	}
+
+	sort.Sort(aggregateFullFileRead)
+	if len(seekDistances) > 0 {
+		sort.Sort(seekDistances)
+	}
+
+	if !isText {
+		return report(aggregateFullFileRead, hist, seekDistances)
+	}
+
+	reportHistogram(
+		"read(2) latencies (all workers)", *fReadSize, hist, ptiles)
+
+	if len(seekDistances) > 0 {
+		reportDistances("Seek distances (all workers)", seekDistances, ptiles)
+	}
+
+	seconds := float64(elapsed) / float64(time.Second)
+	fmt.Printf(
+		"\nAggregate throughput: %s/s across %d worker(s)\n",
+		formatBytes(float64(totalBytes)/seconds),
+		*fConcurrency)
 
 	return
 }
@@ -227,7 +1164,52 @@ func main() {
 	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
 	flag.Parse()
 
-	err := run()
+	if *fCPUProfile != "" {
+		f, err := os.Create(*fCPUProfile)
+		if err != nil {
+			log.Fatalf("Creating CPU profile: %v", err)
+		}
+		defer f.Close()
+
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatalf("Starting CPU profile: %v", err)
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	if *fTraceFile != "" {
+		f, err := os.Create(*fTraceFile)
+		if err != nil {
+			log.Fatalf("Creating trace file: %v", err)
+		}
+		defer f.Close()
+
+		if err := trace.Start(f); err != nil {
+			log.Fatalf("Starting trace: %v", err)
+		}
+		defer trace.Stop()
+	}
+
+	var err error
+	if *fConcurrency > 0 {
+		err = runConcurrent()
+	} else {
+		err = run()
+	}
+
+	if *fMemProfile != "" {
+		f, ferr := os.Create(*fMemProfile)
+		if ferr != nil {
+			log.Fatalf("Creating memory profile: %v", ferr)
+		}
+		defer f.Close()
+
+		runtime.GC()
+		if werr := pprof.WriteHeapProfile(f); werr != nil {
+			log.Fatalf("Writing memory profile: %v", werr)
+		}
+	}
+
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
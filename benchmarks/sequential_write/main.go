@@ -0,0 +1,274 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Repeatedly measure the performance of doing the following:
+//
+// 1.  Create a new file.
+// 2.  Write it from start to end with a configurable buffer size.
+// 3.  Close it.
+// 4.  Optionally delete it, according to --delete_percent.
+//
+// This is the write-path companion to the sequential_read tool.
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	mathrand "math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+var fDir = flag.String("dir", "", "Directory within which to write files.")
+var fDuration = flag.Duration("duration", 5*time.Second, "How long to run.")
+var fFileSize = flag.Int64("file_size", 1<<20, "Size of each file to write.")
+var fWriteSize = flag.Int64("write_size", 1<<14, "Size of each call to write(2).")
+
+var fFsync = flag.Bool(
+	"fsync",
+	false,
+	"If set, call fsync(2) on each file before closing it.")
+
+var fDeletePercent = flag.Int(
+	"delete_percent",
+	0,
+	"Percentage (0-100) of written files to delete within the "+
+		"measurement window, exercising the delete path alongside writes.")
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+type DurationSlice []time.Duration
+
+func (p DurationSlice) Len() int           { return len(p) }
+func (p DurationSlice) Less(i, j int) bool { return p[i] < p[j] }
+func (p DurationSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// REQUIRES: vals is sorted.
+// REQUIRES: len(vals) > 0
+// REQUIRES: 0 <= p <= 100
+func percentile(
+	vals DurationSlice,
+	p int) (x time.Duration) {
+	// We use the NIST method:
+	//
+	//     https://en.wikipedia.org/wiki/Percentile#NIST_method
+	//
+	// Begin by computing the rank.
+	N := len(vals)
+	rank := (float64(p) / 100) * float64(N+1)
+	kFloat, d := math.Modf(rank)
+	k := int(kFloat)
+
+	// Handle each case.
+	switch {
+	case k == 0:
+		x = vals[0]
+		return
+
+	case k >= N:
+		x = vals[N-1]
+		return
+
+	case 0 < k && k < N:
+		xFloat := float64(vals[k-1]) + d*float64(vals[k]-vals[k-1])
+		x = time.Duration(xFloat)
+		return
+
+	default:
+		panic("Invalid input")
+	}
+}
+
+func formatBytes(v float64) string {
+	switch {
+	case v >= 1<<30:
+		return fmt.Sprintf("%.2f GiB", v/(1<<30))
+
+	case v >= 1<<20:
+		return fmt.Sprintf("%.2f MiB", v/(1<<20))
+
+	case v >= 1<<10:
+		return fmt.Sprintf("%.2f KiB", v/(1<<10))
+
+	default:
+		return fmt.Sprintf("%.2f bytes", v)
+	}
+}
+
+// The percentiles reported for each observed metric.
+var ptiles = []int{50, 90, 98}
+
+func reportSlice(
+	name string,
+	bytesPerObservation int64,
+	observations DurationSlice,
+	ptiles []int) {
+	fmt.Printf("\n%s:\n", name)
+	for _, ptile := range ptiles {
+		d := percentile(observations, ptile)
+		seconds := float64(d) / float64(time.Second)
+		bandwidthBytesPerSec := float64(bytesPerObservation) / seconds
+
+		fmt.Printf(
+			"  %02dth ptile: %10v (%s/s)\n",
+			ptile,
+			d,
+			formatBytes(bandwidthBytesPerSec))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// main logic
+////////////////////////////////////////////////////////////////////////
+
+func run() (err error) {
+	if *fDir == "" {
+		err = errors.New("You must set --dir.")
+		return
+	}
+
+	if *fDeletePercent < 0 || *fDeletePercent > 100 {
+		err = errors.New("--delete_percent must be between 0 and 100.")
+		return
+	}
+
+	// Fill a reusable buffer with random content up front, rather than
+	// reading crypto/rand on every write(2), so we measure the filesystem
+	// rather than the RNG.
+	buf := make([]byte, *fWriteSize)
+	_, err = io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		err = fmt.Errorf("Filling write buffer: %v", err)
+		return
+	}
+
+	// Run several iterations, keeping track of the files we don't delete so
+	// we can clean them up at the end.
+	log.Printf("Measuring for %v...", *fDuration)
+
+	var fullFileWrite DurationSlice
+	var singleWriteCall DurationSlice
+	var kept []string
+	var deleted int
+
+	// Clean up whatever files we don't delete along the way. Registered
+	// before the loop, rather than after, so that an error return from
+	// partway through the loop still cleans up the files kept so far.
+	defer func() {
+		for _, path := range kept {
+			log.Printf("Deleting %s.", path)
+			os.Remove(path)
+		}
+	}()
+
+	overallStartTime := time.Now()
+	for len(fullFileWrite) == 0 || time.Since(overallStartTime) < *fDuration {
+		// Create a new file.
+		var f *os.File
+		f, err = ioutil.TempFile(*fDir, "sequential_write")
+		if err != nil {
+			err = fmt.Errorf("TempFile: %v", err)
+			return
+		}
+
+		path := f.Name()
+
+		// Write it from start to end.
+		fileStartTime := time.Now()
+		for remaining := *fFileSize; remaining > 0; {
+			n := int64(len(buf))
+			if n > remaining {
+				n = remaining
+			}
+
+			writeStartTime := time.Now()
+			_, err = f.Write(buf[:n])
+			singleWriteCall = append(singleWriteCall, time.Since(writeStartTime))
+			if err != nil {
+				err = fmt.Errorf("Writing: %v", err)
+				return
+			}
+
+			remaining -= n
+		}
+
+		if *fFsync {
+			err = f.Sync()
+			if err != nil {
+				err = fmt.Errorf("Syncing: %v", err)
+				return
+			}
+		}
+
+		fullFileWrite = append(fullFileWrite, time.Since(fileStartTime))
+
+		// Close the file.
+		err = f.Close()
+		if err != nil {
+			err = fmt.Errorf("Closing file after writing: %v", err)
+			return
+		}
+
+		// Delete it immediately with the configured probability, exercising
+		// the delete path; otherwise remember it for cleanup at the end.
+		if *fDeletePercent > 0 && mathrand.Intn(100) < *fDeletePercent {
+			err = os.Remove(path)
+			if err != nil {
+				err = fmt.Errorf("Removing file: %v", err)
+				return
+			}
+
+			deleted++
+		} else {
+			kept = append(kept, path)
+		}
+	}
+
+	sort.Sort(fullFileWrite)
+	sort.Sort(singleWriteCall)
+
+	log.Printf(
+		"Wrote %d files, using %d calls to write(2); deleted %d of them.",
+		len(fullFileWrite),
+		len(singleWriteCall),
+		deleted)
+
+	// Report.
+	reportSlice("Full-file write times", *fFileSize, fullFileWrite, ptiles)
+	reportSlice("write(2) latencies", *fWriteSize, singleWriteCall, ptiles)
+
+	fmt.Println()
+
+	return
+}
+
+func main() {
+	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}